@@ -0,0 +1,82 @@
+package stream
+
+// Event is a single update to be sent to a subscriber. It can be a concrete
+// state change (Payload holds the state store's payload type for the topic),
+// a batch of such changes, or one of the sentinel control events below
+// (end-of-snapshot, empty-snapshot, or a request to re-snapshot).
+type Event struct {
+	Topic Topic
+	Key   string
+	Index uint64
+
+	Payload interface{}
+}
+
+// endOfSnapshot is a sentinel Payload marking that the snapshot portion of a
+// subscription's events has been fully delivered, and that the subscriber is
+// now caught up to Index and will receive live updates from here on.
+type endOfSnapshot struct{}
+
+// endOfEmptySnapshot is like endOfSnapshot but sent instead of it when the
+// topic had no events at all to send as part of the snapshot.
+type endOfEmptySnapshot struct{}
+
+// newSnapshotToFollow is a sentinel Payload telling the subscriber that the
+// events it requested (by Index) are no longer available from the server's
+// buffer, so the server is about to start over with a fresh snapshot. The
+// subscriber should discard any local state derived from the prior snapshot
+// before consuming what follows.
+type newSnapshotToFollow struct{}
+
+// IsEndOfSnapshot returns true if this is a sentinel event representing the
+// end of a snapshot.
+func (e Event) IsEndOfSnapshot() bool {
+	_, ok := e.Payload.(endOfSnapshot)
+	return ok
+}
+
+// IsEndOfEmptySnapshot returns true if this is a sentinel event representing
+// the end of an empty snapshot (i.e. no events were found for the snapshot).
+func (e Event) IsEndOfEmptySnapshot() bool {
+	_, ok := e.Payload.(endOfEmptySnapshot)
+	return ok
+}
+
+// IsNewSnapshotToFollow returns true if this is a sentinel event telling the
+// subscriber that the server is about to replace the snapshot it previously
+// sent with a fresh one, because the index it requested a replay from could
+// no longer be served from the buffer.
+func (e Event) IsNewSnapshotToFollow() bool {
+	_, ok := e.Payload.(newSnapshotToFollow)
+	return ok
+}
+
+// NewSnapshotToFollowEvent returns a sentinel event with the given index that
+// tells a subscriber a new snapshot is about to follow.
+func NewSnapshotToFollowEvent(index uint64) Event {
+	return Event{Index: index, Payload: newSnapshotToFollow{}}
+}
+
+// Filter applies keep to this event, returning a (possibly modified) event
+// and whether it should be delivered at all. Sentinel and single-item events
+// are kept unmodified as long as keep reports true for them; a batch event
+// (Payload of type []Event, as produced when several updates are coalesced
+// into one Event) is narrowed down to the items that keep accepts.
+func (e Event) Filter(keep func(Event) bool) (Event, bool) {
+	switch p := e.Payload.(type) {
+	case []Event:
+		var kept []Event
+		for _, event := range p {
+			if event, ok := event.Filter(keep); ok {
+				kept = append(kept, event)
+			}
+		}
+		if len(kept) == 0 {
+			return Event{}, false
+		}
+		e.Payload = kept
+		return e, true
+	default:
+		return e, keep(e)
+	}
+}
@@ -0,0 +1,225 @@
+package stream
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// bufferItem is a node in the linked list of events buffered for a topic.
+// Each item is created once and never mutated (other than its next pointer
+// being set exactly once), which lets every Subscription walk the list
+// concurrently without needing to copy it.
+type bufferItem struct {
+	// Events is the set of events published together (at Index). Empty for
+	// the sentinel item that starts a new, otherwise-empty buffer.
+	Events []Event
+
+	// Index is the Raft index the Events were published at. Zero for the
+	// sentinel item.
+	Index uint64
+
+	// Err is set on the final item of a buffer that can no longer produce
+	// more events, because the publisher is shutting down.
+	Err error
+
+	// Seq and ByteSeq are monotonically increasing counters of, respectively,
+	// the number of items and the approximate cumulative byte size of the
+	// buffer up to and including this item. They let a Subscription work out
+	// how far behind the live tail it has fallen in O(1), without walking
+	// the chain.
+	Seq     uint64
+	ByteSeq uint64
+
+	storedAt time.Time
+
+	mu    sync.Mutex
+	next  *bufferItem
+	ready chan struct{}
+}
+
+func newBufferItem() *bufferItem {
+	return &bufferItem{ready: make(chan struct{}), storedAt: timeNow()}
+}
+
+// Next returns the item appended after i, blocking until it is available or
+// ctx (or closeCh, if non-nil) is done.
+func (i *bufferItem) Next(ctx context.Context, closeCh <-chan struct{}) (*bufferItem, error) {
+	i.mu.Lock()
+	next := i.next
+	i.mu.Unlock()
+	if next != nil {
+		return next, nil
+	}
+
+	select {
+	case <-i.ready:
+		i.mu.Lock()
+		next := i.next
+		i.mu.Unlock()
+		return next, nil
+	case <-closeCh:
+		return nil, ErrSubscriptionClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// link appends next after i and wakes any readers blocked in Next.
+func (i *bufferItem) link(next *bufferItem) {
+	i.mu.Lock()
+	i.next = next
+	i.mu.Unlock()
+	close(i.ready)
+}
+
+// eventBuffer is the live, bounded tail of events published for a single
+// topic. New events are appended at the tail; old events are trimmed from
+// the head once they fall outside of retentionDuration or the buffer grows
+// past byteCapacity, whichever comes first. A Subscription that asks to
+// resume from an Index that has already been trimmed off the head cannot be
+// served from the buffer and must be sent a fresh snapshot instead.
+type eventBuffer struct {
+	retentionDuration time.Duration
+	byteCapacity      int
+
+	mu   sync.Mutex
+	head *bufferItem
+	tail *bufferItem
+	size int
+
+	// floorIndex is the Index of the most recent item evicted from the
+	// head, i.e. the highest index a resuming subscriber can NOT be served
+	// from the buffer for.
+	floorIndex uint64
+
+	seq     uint64 // Seq assigned to tail
+	byteSeq uint64 // ByteSeq assigned to tail
+}
+
+func newEventBuffer(retention time.Duration, byteCapacity int) *eventBuffer {
+	head := newBufferItem()
+	return &eventBuffer{
+		retentionDuration: retention,
+		byteCapacity:      byteCapacity,
+		head:              head,
+		tail:              head,
+	}
+}
+
+// Head returns the oldest item still retained in the buffer.
+func (b *eventBuffer) Head() *bufferItem {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.head
+}
+
+// Tail returns the most recently appended item.
+func (b *eventBuffer) Tail() *bufferItem {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tail
+}
+
+// FloorIndex returns the highest Index that has already been evicted from
+// the buffer and so can no longer be replayed from it.
+func (b *eventBuffer) FloorIndex() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.floorIndex
+}
+
+// Append adds a new item to the tail of the buffer and trims the head down
+// to retentionDuration/byteCapacity.
+func (b *eventBuffer) Append(index uint64, events []Event) {
+	b.mu.Lock()
+	b.seq++
+	b.byteSeq += uint64(approxEventsSize(events))
+	item := &bufferItem{
+		Events:   events,
+		Index:    index,
+		Seq:      b.seq,
+		ByteSeq:  b.byteSeq,
+		storedAt: timeNow(),
+		ready:    make(chan struct{}),
+	}
+
+	b.tail.link(item)
+	b.tail = item
+	b.size += approxEventsSize(events)
+	b.trimLocked()
+	b.mu.Unlock()
+}
+
+// Closed terminates the buffer, delivering err to every subscriber currently
+// waiting on, or that later reaches, the tail.
+func (b *eventBuffer) Closed(err error) {
+	b.mu.Lock()
+	b.seq++
+	item := &bufferItem{Err: err, Seq: b.seq, ByteSeq: b.byteSeq, storedAt: timeNow(), ready: make(chan struct{})}
+	b.tail.link(item)
+	b.tail = item
+	b.mu.Unlock()
+}
+
+// trimLocked drops items from the head while the buffer exceeds its
+// configured retention window or byte cap. Must be called with b.mu held.
+func (b *eventBuffer) trimLocked() {
+	for b.head.next != nil {
+		age := timeNow().Sub(b.head.storedAt)
+		overRetention := b.retentionDuration > 0 && age > b.retentionDuration
+		overCapacity := b.byteCapacity > 0 && b.size > b.byteCapacity
+
+		if !overRetention && !overCapacity {
+			return
+		}
+
+		b.size -= approxEventsSize(b.head.Events)
+		if b.head.Index > b.floorIndex {
+			b.floorIndex = b.head.Index
+		}
+		b.head = b.head.next
+	}
+}
+
+// LagFrom returns how many items, and approximately how many bytes, behind
+// the current tail item is, for use by a Subscription enforcing a
+// SubscriberPolicy.
+func (b *eventBuffer) LagFrom(item *bufferItem) (events uint64, bytes uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.seq - item.Seq, b.byteSeq - item.ByteSeq
+}
+
+// findFromIndex walks the buffer looking for the item published at index,
+// returning the item a Subscription should resume from (such that the next
+// event it reads is the first with Index > index) and true on success. ok is
+// false when index has already been trimmed from the buffer (or was never
+// seen), meaning the caller must fall back to a fresh snapshot.
+func (b *eventBuffer) findFromIndex(index uint64) (item *bufferItem, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if index < b.floorIndex {
+		return nil, false
+	}
+
+	for cur := b.head; cur != nil; cur = cur.next {
+		if cur.Index == index {
+			return cur, true
+		}
+	}
+	return nil, false
+}
+
+// approxEventsSize is a cheap, deliberately rough estimate of the number of
+// bytes a batch of events occupies, used only to enforce eventBuffer's byte
+// cap. It does not need to be exact.
+func approxEventsSize(events []Event) int {
+	const perEventOverhead = 64
+	size := 0
+	for range events {
+		size += perEventOverhead
+	}
+	return size
+}
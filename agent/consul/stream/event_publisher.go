@@ -0,0 +1,427 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// timeNow is a var so that it can be overridden in tests.
+var timeNow = time.Now
+
+const (
+	// defaultTopicBufferRetention is how long a topic's buffered events are
+	// kept around to serve replays to reconnecting subscribers, when the
+	// EventPublisher wasn't configured with an explicit retention window.
+	defaultTopicBufferRetention = 2 * time.Minute
+
+	// defaultTopicBufferByteCap bounds the approximate memory a single
+	// topic's buffer can use, regardless of how recent its events are, when
+	// the EventPublisher wasn't configured with an explicit cap.
+	defaultTopicBufferByteCap = 512 * 1024
+)
+
+// EventPublisher receives changes from Publish, appends them to the
+// relevant topic buffers, and lets callers Subscribe to a stream of those
+// changes (optionally resuming from a previously seen Index) scoped to a
+// topic and key.
+type EventPublisher struct {
+	snapshotHandlers SnapshotHandlers
+	snapshotCacheTTL time.Duration
+
+	// TopicBufferRetention and TopicBufferByteCap configure the per-topic
+	// ring buffer used to serve replays to reconnecting subscribers. Zero
+	// means "use the default"; set either to a negative value to disable
+	// that limit entirely. They must not be changed once Run has been
+	// called.
+	TopicBufferRetention time.Duration
+	TopicBufferByteCap   int
+
+	publishCh chan []Event
+
+	metrics Metrics
+
+	mu            sync.Mutex
+	topicBuffers  map[Topic]*eventBuffer
+	snapshotCache map[subscriptionKey]*snapshotCacheEntry
+	legsByTopic   map[Topic]map[*subscriptionLeg]struct{}
+}
+
+// PublisherOption configures optional behavior on an EventPublisher created
+// by NewEventPublisher.
+type PublisherOption func(*EventPublisher)
+
+// WithMetrics reports the gauges and counters used to enforce each
+// subscriber's SubscriberPolicy to m, instead of discarding them. A nil m is
+// ignored, leaving the default noopMetrics in place.
+func WithMetrics(m Metrics) PublisherOption {
+	return func(e *EventPublisher) {
+		if m != nil {
+			e.metrics = m
+		}
+	}
+}
+
+// subscriptionKey identifies a distinct snapshot: all subscribers asking for
+// the same Topic/Key can share one.
+type subscriptionKey struct {
+	Topic Topic
+	Key   string
+}
+
+type snapshotCacheEntry struct {
+	expiresAt time.Time
+	head      *bufferItem
+	index     uint64
+	err       error
+}
+
+// NewEventPublisher creates an EventPublisher that uses the given handlers
+// to build snapshots for new subscribers. Subscribers to the same topic/key
+// within snapshotCacheTTL of the one whose subscription built a snapshot
+// reuse that snapshot rather than each triggering a new one. Run must be called before
+// any events published or subscribed to are visible.
+func NewEventPublisher(handlers SnapshotHandlers, snapshotCacheTTL time.Duration, opts ...PublisherOption) *EventPublisher {
+	e := &EventPublisher{
+		snapshotHandlers: handlers,
+		snapshotCacheTTL: snapshotCacheTTL,
+		publishCh:        make(chan []Event, 64),
+		metrics:          noopMetrics{},
+		topicBuffers:     make(map[Topic]*eventBuffer),
+		snapshotCache:    make(map[subscriptionKey]*snapshotCacheEntry),
+		legsByTopic:      make(map[Topic]map[*subscriptionLeg]struct{}),
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e
+}
+
+// Run consumes published events until ctx is cancelled, at which point every
+// current Subscription is closed with ErrSubscriptionClosed. A Subscription
+// made afterwards gets ErrSubscriptionClosed once it reads past its snapshot
+// only if its topic already had a buffer at shutdown; one for a topic first
+// seen after shutdown is not closed. Run blocks and is intended to be called in its own goroutine.
+func (e *EventPublisher) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			e.shutdown()
+			return
+		case events := <-e.publishCh:
+			e.publishEvents(events)
+		}
+	}
+}
+
+// Publish appends events to their topic buffers, waking any subscribers
+// blocked waiting for them. It is safe to call concurrently, including
+// before Run has been started (events are queued).
+func (e *EventPublisher) Publish(events []Event) {
+	if len(events) == 0 {
+		return
+	}
+	e.publishCh <- events
+}
+
+func (e *EventPublisher) publishEvents(events []Event) {
+	byTopic := make(map[Topic][]Event)
+	for _, event := range events {
+		byTopic[event.Topic] = append(byTopic[event.Topic], event)
+	}
+
+	for topic, events := range byTopic {
+		buf := e.topicBufferForTopic(topic)
+		buf.Append(topicEventsIndex(events), events)
+		e.enforceTopicPolicies(topic)
+	}
+}
+
+// enforceTopicPolicies applies every subscriber's SubscriberPolicy for topic
+// now that new events have landed in its buffer, and reports the resulting
+// lagged_subscribers count.
+func (e *EventPublisher) enforceTopicPolicies(topic Topic) {
+	e.mu.Lock()
+	legs := make([]*subscriptionLeg, 0, len(e.legsByTopic[topic]))
+	for leg := range e.legsByTopic[topic] {
+		legs = append(legs, leg)
+	}
+	e.mu.Unlock()
+
+	if len(legs) == 0 {
+		return
+	}
+
+	lagged := 0
+	for _, leg := range legs {
+		if leg.enforcePolicy(e.metrics) {
+			lagged++
+		}
+	}
+	e.metrics.SetLaggedSubscribers(topic, lagged)
+}
+
+func topicEventsIndex(events []Event) uint64 {
+	var index uint64
+	for _, event := range events {
+		if event.Index > index {
+			index = event.Index
+		}
+	}
+	return index
+}
+
+// shutdown closes every topic buffer (so any leg already reading past its
+// snapshot sees ErrSubscriptionClosed once it reaches the tail) and also
+// force-closes every live Subscription directly: a leg still working
+// through its own snapshot chain, spliced ahead of the buffer's tail, would
+// otherwise never reach the now-closed tail and could keep returning
+// snapshot events after shutdown.
+func (e *EventPublisher) shutdown() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, buf := range e.topicBuffers {
+		buf.Closed(ErrSubscriptionClosed)
+	}
+	for _, legs := range e.legsByTopic {
+		for leg := range legs {
+			leg.sub.forceCloseWith(ErrSubscriptionClosed)
+		}
+	}
+}
+
+func (e *EventPublisher) topicBufferForTopic(topic Topic) *eventBuffer {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.topicBufferForTopicLocked(topic)
+}
+
+func (e *EventPublisher) topicBufferForTopicLocked(topic Topic) *eventBuffer {
+	buf, ok := e.topicBuffers[topic]
+	if !ok {
+		buf = newEventBuffer(e.retentionDuration(), e.byteCapacity())
+		e.topicBuffers[topic] = buf
+	}
+	return buf
+}
+
+func (e *EventPublisher) retentionDuration() time.Duration {
+	switch {
+	case e.TopicBufferRetention < 0:
+		return 0
+	case e.TopicBufferRetention > 0:
+		return e.TopicBufferRetention
+	default:
+		return defaultTopicBufferRetention
+	}
+}
+
+func (e *EventPublisher) byteCapacity() int {
+	switch {
+	case e.TopicBufferByteCap < 0:
+		return 0
+	case e.TopicBufferByteCap > 0:
+		return e.TopicBufferByteCap
+	default:
+		return defaultTopicBufferByteCap
+	}
+}
+
+// Subscribe returns a new Subscription for the given request. A request
+// naming more than one TopicKey (via Topics) delivers every one of them on
+// a single merged stream; see Subscription.Next. The common, single-Topic
+// case: if req.Index is zero, or refers to an event no longer held in the
+// topic's buffer, the Subscription starts with a snapshot of the current
+// state (preceded by a NewSnapshotToFollow event in the latter case) before
+// switching to live events; otherwise it resumes directly from the buffer,
+// replaying whatever was published with a greater Index. Index-based resume
+// is only honored for a single-TopicKey request; a Subscription spanning
+// more than one TopicKey always starts with a fresh snapshot per topic.
+func (e *EventPublisher) Subscribe(req *SubscribeRequest) (*Subscription, error) {
+	filter, err := newEventFilter(req.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	topicKeys := req.topicKeys()
+	resumable := len(topicKeys) == 1
+
+	legs := make([]*subscriptionLeg, 0, len(topicKeys))
+	for _, tk := range topicKeys {
+		leg, err := e.subscribeLeg(*req, tk, resumable)
+		if err != nil {
+			return nil, err
+		}
+		legs = append(legs, leg)
+	}
+
+	var sub *Subscription
+	sub = newSubscription(*req, legs, filter, func() { e.removeSubscriber(sub) })
+	e.addSubscriber(sub)
+	return sub, nil
+}
+
+// subscribeLeg builds the subscriptionLeg that serves tk for req.
+func (e *EventPublisher) subscribeLeg(req SubscribeRequest, tk TopicKey, resumable bool) (*subscriptionLeg, error) {
+	e.mu.Lock()
+	buf := e.topicBufferForTopicLocked(tk.Topic)
+	e.mu.Unlock()
+
+	legReq := req
+	legReq.Topic, legReq.Key = tk.Topic, tk.Key
+
+	if resumable && req.Index > 0 {
+		if item, ok := buf.findFromIndex(req.Index); ok {
+			leg := newSubscriptionLeg(tk.Topic, tk.Key, item, buf)
+			// item itself is the one published at req.Index, which the
+			// subscriber already has; skip straight to what follows it.
+			leg.currentIdx = len(item.Events)
+			return leg, nil
+		}
+	}
+
+	snapHead, err := e.getSnapshotLocked(legReq, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	if resumable && req.Index > 0 {
+		// The client asked to resume but we could no longer serve it from
+		// the buffer: tell it a new snapshot is coming before sending one.
+		notice := newSnapshotBufferItem(snapHead)
+		event := NewSnapshotToFollowEvent(req.Index)
+		event.Topic, event.Key = tk.Topic, tk.Key
+		notice.Events = []Event{event}
+		notice.link(snapHead)
+		return newSubscriptionLeg(tk.Topic, tk.Key, notice, buf), nil
+	}
+
+	return newSubscriptionLeg(tk.Topic, tk.Key, snapHead, buf), nil
+}
+
+func (e *EventPublisher) addSubscriber(sub *Subscription) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, leg := range sub.legs {
+		legs, ok := e.legsByTopic[leg.topic]
+		if !ok {
+			legs = make(map[*subscriptionLeg]struct{})
+			e.legsByTopic[leg.topic] = legs
+		}
+		legs[leg] = struct{}{}
+		e.metrics.SetSubscribers(leg.topic, len(legs))
+	}
+}
+
+func (e *EventPublisher) removeSubscriber(sub *Subscription) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, leg := range sub.legs {
+		legs, ok := e.legsByTopic[leg.topic]
+		if !ok {
+			continue
+		}
+		delete(legs, leg)
+		e.metrics.SetSubscribers(leg.topic, len(legs))
+	}
+}
+
+// getSnapshotLocked returns the head of a (possibly cached) chain of buffer
+// items holding the snapshot for req, whose tail is spliced onto buf so that
+// a subscriber reading past the snapshot continues seamlessly into live
+// events.
+func (e *EventPublisher) getSnapshotLocked(req SubscribeRequest, buf *eventBuffer) (*bufferItem, error) {
+	key := subscriptionKey{Topic: req.Topic, Key: req.Key}
+
+	e.mu.Lock()
+	if cached, ok := e.snapshotCache[key]; ok && e.snapshotCacheTTL > 0 && timeNow().Before(cached.expiresAt) {
+		e.mu.Unlock()
+		if cached.err != nil {
+			return nil, cached.err
+		}
+		return cached.head, nil
+	}
+	e.mu.Unlock()
+
+	handler, ok := e.snapshotHandlers[req.Topic]
+	if !ok {
+		return nil, errUnknownTopic(req.Topic)
+	}
+
+	snap := &eventSnapshotBuilder{}
+	index, err := handler(req, snap)
+	if err != nil {
+		return nil, err
+	}
+
+	head := snap.buildChain(req.Topic, req.Key, index, buf.Tail())
+
+	if e.snapshotCacheTTL > 0 {
+		e.mu.Lock()
+		e.snapshotCache[key] = &snapshotCacheEntry{
+			expiresAt: timeNow().Add(e.snapshotCacheTTL),
+			head:      head,
+			index:     index,
+		}
+		e.mu.Unlock()
+	}
+
+	return head, nil
+}
+
+// eventSnapshotBuilder implements SnapshotAppender by accumulating the
+// events a SnapshotFunc appends into a linked chain of bufferItems ending
+// with an end-of-snapshot sentinel spliced onto the live buffer's tail.
+type eventSnapshotBuilder struct {
+	events []Event
+}
+
+func errUnknownTopic(topic Topic) error {
+	return fmt.Errorf("unknown topic %v", topic)
+}
+
+func (s *eventSnapshotBuilder) Append(events []Event) {
+	s.events = append(s.events, events...)
+}
+
+func (s *eventSnapshotBuilder) buildChain(topic Topic, key string, index uint64, liveTail *bufferItem) *bufferItem {
+	// Every synthetic node built here precedes liveTail in the stream, so it
+	// inherits liveTail's Seq/ByteSeq: a subscriber sitting anywhere in this
+	// chain hasn't missed any *live* events yet, and subscriptionLeg.enforcePolicy
+	// compares against these to measure lag.
+	head := newSnapshotBufferItem(liveTail)
+	cur := head
+
+	if len(s.events) == 0 {
+		end := newSnapshotBufferItem(liveTail)
+		end.Events = []Event{{Topic: topic, Key: key, Index: index, Payload: endOfEmptySnapshot{}}}
+		cur.link(end)
+		cur = end
+	} else {
+		item := newSnapshotBufferItem(liveTail)
+		item.Events = s.events
+		item.Index = index
+		cur.link(item)
+		cur = item
+
+		end := newSnapshotBufferItem(liveTail)
+		end.Events = []Event{{Topic: topic, Key: key, Index: index, Payload: endOfSnapshot{}}}
+		cur.link(end)
+		cur = end
+	}
+
+	cur.link(liveTail)
+	return head
+}
+
+// newSnapshotBufferItem creates a bufferItem that precedes liveTail in the
+// stream but isn't part of the buffer's own linked list (e.g. snapshot or
+// new-snapshot-to-follow notices), carrying liveTail's Seq/ByteSeq forward
+// so lag accounting treats it as caught up until the buffer advances again.
+func newSnapshotBufferItem(liveTail *bufferItem) *bufferItem {
+	item := newBufferItem()
+	item.Seq = liveTail.Seq
+	item.ByteSeq = liveTail.ByteSeq
+	return item
+}
@@ -2,6 +2,7 @@ package stream
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"testing"
 	"time"
@@ -155,3 +156,218 @@ func consumeSub(ctx context.Context, sub *Subscription) error {
 		}
 	}
 }
+
+// testMetrics is a Metrics that records what it was called with, for
+// assertions in the SubscriberPolicy tests below.
+type testMetrics struct {
+	evictions     map[Topic]int
+	droppedEvents map[Topic]int
+}
+
+func newTestMetrics() *testMetrics {
+	return &testMetrics{evictions: map[Topic]int{}, droppedEvents: map[Topic]int{}}
+}
+
+func (m *testMetrics) SetSubscribers(Topic, int)       {}
+func (m *testMetrics) SetLaggedSubscribers(Topic, int) {}
+func (m *testMetrics) IncrDroppedEvents(topic Topic, count int) {
+	m.droppedEvents[topic] += count
+}
+func (m *testMetrics) IncrEvictions(topic Topic) {
+	m.evictions[topic]++
+}
+
+func TestEventPublisher_SubscriberPolicyCloseOnLag(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	handlers := SnapshotHandlers{testTopic: func(req SubscribeRequest, buf SnapshotAppender) (uint64, error) {
+		return 0, nil
+	}}
+	metrics := newTestMetrics()
+	publisher := NewEventPublisher(handlers, 0, WithMetrics(metrics))
+	go publisher.Run(ctx)
+
+	sub, err := publisher.Subscribe(&SubscribeRequest{
+		Topic:        testTopic,
+		Policy:       SubscriberPolicyCloseOnLag,
+		MaxLagEvents: 2,
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+
+	// Drain the empty-snapshot sentinel so the leg sits at the live tail
+	// before any events are published.
+	_, err = sub.Next(ctx)
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		publisher.Publish([]Event{{Topic: testTopic, Payload: i}})
+	}
+
+	require.Eventually(t, func() bool {
+		_, err := sub.Next(ctx)
+		return errors.Is(err, ErrSubscriptionLagged)
+	}, time.Second, 10*time.Millisecond)
+
+	require.Equal(t, 1, metrics.evictions[testTopic])
+}
+
+// TestSubscriptionLeg_CoalesceLocked_KeepsLagAccountingCaughtUp guards
+// against coalesceLocked's synthetic chain reporting a bogus lag: the chain
+// it builds must carry the live tail's Seq/ByteSeq forward (like
+// newSnapshotBufferItem does for snapshot nodes), or the very next
+// enforcePolicy call sees a leg that just caught up as still lagged.
+func TestSubscriptionLeg_CoalesceLocked_KeepsLagAccountingCaughtUp(t *testing.T) {
+	buf := newEventBuffer(0, 0)
+	for i := 0; i < 5; i++ {
+		buf.Append(uint64(i+1), []Event{{Key: "k", Payload: i}})
+	}
+
+	sub := &Subscription{req: SubscribeRequest{Policy: SubscriberPolicyDropOldest, MaxLagEvents: 1}}
+	leg := newSubscriptionLeg(testTopic, "", buf.Head(), buf)
+	leg.sub = sub
+
+	leg.mu.Lock()
+	dropped := leg.coalesceLocked()
+	leg.mu.Unlock()
+	require.Equal(t, 4, dropped)
+
+	lagged := leg.enforcePolicy(noopMetrics{})
+	require.False(t, lagged, "a leg that was just coalesced up to the live tail shouldn't immediately appear lagged again")
+}
+
+// TestEventPublisher_IndexResume_EvictedFallsBackToSnapshot covers a
+// reconnecting subscriber whose requested Index has already been trimmed
+// off the topic buffer's head: it must fall back to a fresh snapshot
+// (preceded by a NewSnapshotToFollow notice) rather than erroring or
+// silently skipping events.
+func TestEventPublisher_IndexResume_EvictedFallsBackToSnapshot(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	handlers := SnapshotHandlers{testTopic: func(req SubscribeRequest, buf SnapshotAppender) (uint64, error) {
+		buf.Append([]Event{{Payload: "fresh-snapshot", Key: "k"}})
+		return 99, nil
+	}}
+	publisher := NewEventPublisher(handlers, 0)
+	publisher.TopicBufferRetention = time.Millisecond
+	go publisher.Run(ctx)
+
+	publisher.Publish([]Event{{Topic: testTopic, Key: "k", Index: 1, Payload: "old"}})
+	time.Sleep(20 * time.Millisecond)
+	// This second Append is what actually runs trimLocked and evicts the
+	// first event, now that it's older than TopicBufferRetention.
+	publisher.Publish([]Event{{Topic: testTopic, Key: "k", Index: 2, Payload: "newer"}})
+
+	// Publish only enqueues onto Run's channel; wait for it to have actually
+	// been processed (and the first event trimmed) before subscribing,
+	// rather than racing Run's goroutine.
+	require.Eventually(t, func() bool {
+		return publisher.topicBufferForTopic(testTopic).FloorIndex() >= 1
+	}, time.Second, time.Millisecond)
+
+	sub, err := publisher.Subscribe(&SubscribeRequest{Topic: testTopic, Key: "k", Index: 1})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+
+	event, err := sub.Next(ctx)
+	require.NoError(t, err)
+	require.True(t, event.IsNewSnapshotToFollow())
+
+	event, err = sub.Next(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "fresh-snapshot", event.Payload)
+}
+
+// filterTestPayload is a minimal payload type for exercising
+// SubscribeRequest.Filter against a real bexpr expression.
+type filterTestPayload struct {
+	Flag bool
+}
+
+// TestSubscription_Filter_SkipsNonMatchingEventsAtDispatch guards against
+// Filter being enforced only downstream at the RPC layer: a Subscription's
+// compiled Filter must already be applied as events are read off the
+// buffer (subscriptionLeg.next), so a non-matching event is never handed
+// back from Next at all.
+func TestSubscription_Filter_SkipsNonMatchingEventsAtDispatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	handlers := SnapshotHandlers{testTopic: func(req SubscribeRequest, buf SnapshotAppender) (uint64, error) {
+		return 0, nil
+	}}
+	publisher := NewEventPublisher(handlers, 0)
+	go publisher.Run(ctx)
+
+	sub, err := publisher.Subscribe(&SubscribeRequest{Topic: testTopic, Filter: "Flag == true"})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+
+	// Drain the empty-snapshot sentinel.
+	_, err = sub.Next(ctx)
+	require.NoError(t, err)
+
+	publisher.Publish([]Event{
+		{Topic: testTopic, Payload: filterTestPayload{Flag: false}},
+		{Topic: testTopic, Payload: filterTestPayload{Flag: true}},
+	})
+
+	event, err := sub.Next(ctx)
+	require.NoError(t, err)
+	require.Equal(t, filterTestPayload{Flag: true}, event.Payload)
+}
+
+// TestSubscription_MultiTopic_SnapshotOrderThenMergedLive covers a
+// Subscription spanning more than one TopicKey: each leg's snapshot must be
+// replayed in full, in the order the TopicKeys were requested, followed by
+// exactly one combined end-of-snapshot event, before live events from every
+// leg start arriving concurrently.
+func TestSubscription_MultiTopic_SnapshotOrderThenMergedLive(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	topicA, topicB := intTopic(101), intTopic(102)
+	handlers := SnapshotHandlers{
+		topicA: func(req SubscribeRequest, buf SnapshotAppender) (uint64, error) {
+			buf.Append([]Event{{Payload: "a-snapshot"}})
+			return 1, nil
+		},
+		topicB: func(req SubscribeRequest, buf SnapshotAppender) (uint64, error) {
+			buf.Append([]Event{{Payload: "b-snapshot"}})
+			return 1, nil
+		},
+	}
+	publisher := NewEventPublisher(handlers, 0)
+	go publisher.Run(ctx)
+
+	sub, err := publisher.Subscribe(&SubscribeRequest{
+		Topics: []TopicKey{
+			{Topic: topicA, Key: WildcardSubscription},
+			{Topic: topicB, Key: WildcardSubscription},
+		},
+	})
+	require.NoError(t, err)
+	defer sub.Unsubscribe()
+
+	event, err := sub.Next(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "a-snapshot", event.Payload)
+	require.Equal(t, topicA, event.Topic)
+
+	event, err = sub.Next(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "b-snapshot", event.Payload)
+	require.Equal(t, topicB, event.Topic)
+
+	event, err = sub.Next(ctx)
+	require.NoError(t, err)
+	require.True(t, event.IsEndOfSnapshot())
+
+	publisher.Publish([]Event{{Topic: topicB, Payload: "b-live"}})
+	event, err = sub.Next(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "b-live", event.Payload)
+	require.Equal(t, topicB, event.Topic)
+}
@@ -0,0 +1,39 @@
+package stream
+
+import "github.com/hashicorp/go-bexpr"
+
+// eventFilter is a compiled bexpr expression, cached on a Subscription so
+// that it's parsed once per subscriber rather than once per event.
+type eventFilter struct {
+	evaluator *bexpr.Evaluator
+}
+
+// newEventFilter compiles expression, Consul's existing bexpr grammar (the
+// same one used to filter API responses), for later use against an Event's
+// Payload. An empty expression is not an error: it simply means "no
+// filter", represented as a nil *eventFilter.
+func newEventFilter(expression string) (*eventFilter, error) {
+	if expression == "" {
+		return nil, nil
+	}
+	evaluator, err := bexpr.CreateEvaluator(expression)
+	if err != nil {
+		return nil, err
+	}
+	return &eventFilter{evaluator: evaluator}, nil
+}
+
+// match reports whether payload satisfies the filter. Payload types that
+// the expression doesn't apply to (for example because the expression
+// references a field they don't have) are kept rather than dropped, so a
+// Filter only narrows down payloads it understands.
+func (f *eventFilter) match(payload interface{}) bool {
+	if f == nil {
+		return true
+	}
+	ok, err := f.evaluator.Evaluate(payload)
+	if err != nil {
+		return true
+	}
+	return ok
+}
@@ -0,0 +1,32 @@
+package stream
+
+// Metrics is a pluggable sink for the per-topic gauges and counters
+// EventPublisher reports as it enforces each subscriber's SubscriberPolicy.
+// A nil Metrics passed to NewEventPublisher is replaced with noopMetrics, so
+// callers that don't care about these numbers don't need to implement it.
+type Metrics interface {
+	// SetSubscribers reports the current number of active subscribers for
+	// topic.
+	SetSubscribers(topic Topic, count int)
+
+	// SetLaggedSubscribers reports the current number of subscribers for
+	// topic that are being throttled (DropOldest) or have been evicted
+	// (CloseOnLag) for falling too far behind.
+	SetLaggedSubscribers(topic Topic, count int)
+
+	// IncrDroppedEvents records that count buffered events for topic were
+	// dropped, rather than delivered, because a DropOldest subscriber
+	// coalesced over them.
+	IncrDroppedEvents(topic Topic, count int)
+
+	// IncrEvictions records that a subscriber for topic was closed by the
+	// server (CloseOnLag) for falling too far behind.
+	IncrEvictions(topic Topic)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) SetSubscribers(Topic, int)       {}
+func (noopMetrics) SetLaggedSubscribers(Topic, int) {}
+func (noopMetrics) IncrDroppedEvents(Topic, int)    {}
+func (noopMetrics) IncrEvictions(Topic)             {}
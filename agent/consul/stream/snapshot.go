@@ -0,0 +1,20 @@
+package stream
+
+// SnapshotFunc builds a snapshot for a subscription request: it appends the
+// current state for the requested topic/key to buf, and returns the index
+// at which that state was current. It is called for each new subscriber
+// that can't resume from the topic's buffer, unless a snapshot for the same
+// Topic/Key built within the EventPublisher's snapshotCacheTTL is reused.
+type SnapshotFunc func(req SubscribeRequest, buf SnapshotAppender) (index uint64, err error)
+
+// SnapshotHandlers is a map of SnapshotFunc, keyed by the Topic they can
+// produce a snapshot for. EventPublisher uses it to satisfy the snapshot
+// portion of a new subscription before switching the subscriber over to the
+// live (or buffered) event stream.
+type SnapshotHandlers map[Topic]SnapshotFunc
+
+// SnapshotAppender is used by a SnapshotFunc to append the events that make
+// up a snapshot.
+type SnapshotAppender interface {
+	Append(events []Event)
+}
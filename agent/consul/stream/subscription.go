@@ -0,0 +1,514 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrSubscriptionClosed is a sentinel error returned by Subscription.Next
+// when the subscription has been forcibly closed because the publisher is
+// shutting down/resetting. (A subscriber evicted for lagging gets
+// ErrSubscriptionLagged instead.) Callers should treat it as a signal to reconnect (with the
+// last Index they observed, to resume where they left off) rather than as a
+// terminal failure.
+var ErrSubscriptionClosed = errors.New("subscription closed by server, client should retry")
+
+// ErrSubscriptionLagged is returned by Next when a subscriber using
+// SubscriberPolicyCloseOnLag has fallen more than its configured
+// MaxLagEvents/MaxLagBytes behind the live tail and the server has closed its Subscription rather
+// than continue to hold buffered events for it.
+var ErrSubscriptionLagged = errors.New("subscription closed by server because the subscriber fell too far behind")
+
+// SubscriberPolicy controls what EventPublisher does with a Subscription
+// whose consumer isn't calling Next fast enough to keep up with the topic's
+// buffer.
+type SubscriberPolicy int
+
+const (
+	// SubscriberPolicyBlock is the default: the subscriber may lag the live
+	// tail indefinitely, simply receiving events later than they were
+	// published. MaxLagEvents/MaxLagBytes are ignored.
+	SubscriberPolicyBlock SubscriberPolicy = iota
+
+	// SubscriberPolicyDropOldest coalesces buffered events by Key once the
+	// subscriber falls more than MaxLagEvents/MaxLagBytes behind, so it
+	// catches back up to the live tail having missed intermediate updates
+	// rather than ever falling further behind.
+	SubscriberPolicyDropOldest
+
+	// SubscriberPolicyCloseOnLag closes the Subscription with
+	// ErrSubscriptionLagged once the subscriber falls more than
+	// MaxLagEvents/MaxLagBytes behind.
+	SubscriberPolicyCloseOnLag
+)
+
+// defaultMaxLagEvents is used for a DropOldest/CloseOnLag subscription that
+// didn't set MaxLagEvents explicitly (even if it set MaxLagBytes).
+const defaultMaxLagEvents = 2048
+
+// SubscribeRequest identifies the set of events a Subscription should
+// receive: Topic (and, if the topic supports it, Key) scope which events
+// match, Token is the ACL token the events will be filtered with, and Index
+// lets a reconnecting client resume from where it left off instead of
+// paying for a full snapshot. Policy, MaxLagEvents and MaxLagBytes control
+// how the server treats a subscriber that can't keep up; see
+// SubscriberPolicy. Filter, if set, is a bexpr expression further narrowing
+// down which events are delivered, evaluated against each Event's Payload.
+type SubscribeRequest struct {
+	Topic  Topic
+	Key    string
+	Token  string
+	Index  uint64
+	Filter string
+
+	// Topics lets a single Subscription span more than one TopicKey,
+	// multiplexing every one of them onto a single ordered stream of events
+	// (see Subscription.Next). When set, it takes precedence over Topic/Key.
+	// Index-based resume (see Index above) is only honored when Topics
+	// names exactly one TopicKey; a Subscription spanning more than one
+	// always starts with a fresh snapshot per topic.
+	Topics []TopicKey
+
+	Policy       SubscriberPolicy
+	MaxLagEvents uint64
+	MaxLagBytes  uint64
+}
+
+// topicKeys normalizes req down to the list of TopicKey selectors it
+// subscribes to, falling back to its single Topic/Key when Topics isn't set.
+func (req *SubscribeRequest) topicKeys() []TopicKey {
+	if len(req.Topics) > 0 {
+		return req.Topics
+	}
+	return []TopicKey{{Topic: req.Topic, Key: req.Key}}
+}
+
+// Subscription is a handle to a stream of events for a single
+// SubscribeRequest, possibly spanning more than one TopicKey. Call Next
+// repeatedly to consume events in order; call Unsubscribe once done with it.
+type Subscription struct {
+	req    SubscribeRequest
+	filter *eventFilter
+	legs   []*subscriptionLeg
+
+	mu         sync.Mutex
+	closeErr   error
+	forceClose chan struct{}
+
+	// stopCh is closed by Unsubscribe, so that the background goroutines a
+	// multi-leg Subscription starts to merge its legs stop trying to
+	// deliver once nothing is reading Next anymore.
+	stopOnce sync.Once
+	stopCh   chan struct{}
+
+	// mergeOnce and eventCh back Next for a Subscription with more than one
+	// leg; they're left zero for the (common) single-leg case, which reads
+	// straight off its leg instead.
+	mergeOnce sync.Once
+	eventCh   chan subEventOrErr
+
+	unsub func()
+}
+
+func newSubscription(req SubscribeRequest, legs []*subscriptionLeg, filter *eventFilter, unsub func()) *Subscription {
+	sub := &Subscription{
+		req:        req,
+		filter:     filter,
+		legs:       legs,
+		forceClose: make(chan struct{}),
+		stopCh:     make(chan struct{}),
+		unsub:      unsub,
+	}
+	for _, leg := range legs {
+		leg.sub = sub
+	}
+	return sub
+}
+
+// MatchesFilter reports whether e should be delivered to this Subscription
+// under its (cached, compiled once at Subscribe time) Filter expression.
+// Sentinel events and subscriptions with no Filter always match.
+func (s *Subscription) MatchesFilter(e Event) bool {
+	switch {
+	case s.filter == nil:
+		return true
+	case e.IsEndOfSnapshot(), e.IsEndOfEmptySnapshot(), e.IsNewSnapshotToFollow():
+		return true
+	default:
+		return s.filter.match(e.Payload)
+	}
+}
+
+// Next returns the next event in the subscription, blocking until one is
+// available or ctx is done. Once it returns a non-nil error the
+// Subscription is no longer usable and should be discarded (after calling
+// Unsubscribe).
+//
+// A Subscription spanning more than one TopicKey replays each leg's
+// snapshot in full, in the order they were requested, before a single
+// combined end-of-snapshot event; from there every leg is delivered
+// concurrently, in whatever order their events actually arrive.
+func (s *Subscription) Next(ctx context.Context) (Event, error) {
+	select {
+	case <-s.forceClose:
+		s.mu.Lock()
+		err := s.closeErr
+		s.mu.Unlock()
+		return Event{}, err
+	default:
+	}
+
+	if len(s.legs) == 1 {
+		return s.nextSingle(ctx, s.legs[0])
+	}
+	return s.nextMulti(ctx)
+}
+
+// nextSingle is the common case, a Subscription scoped to exactly one
+// TopicKey: it reads directly off its one leg, with none of the merge
+// overhead nextMulti needs.
+func (s *Subscription) nextSingle(ctx context.Context, leg *subscriptionLeg) (Event, error) {
+	return leg.next(ctx, s.forceClose)
+}
+
+// subEventOrErr is what a multi-leg Subscription's merge goroutines send
+// back to Next.
+type subEventOrErr struct {
+	event Event
+	err   error
+}
+
+// nextMulti reads the next event off a multi-leg Subscription's merged
+// stream, starting the merge goroutines on the first call.
+func (s *Subscription) nextMulti(ctx context.Context) (Event, error) {
+	s.mergeOnce.Do(func() { s.startMerge(ctx) })
+
+	select {
+	case item := <-s.eventCh:
+		return item.event, item.err
+	case <-ctx.Done():
+		return Event{}, ctx.Err()
+	}
+}
+
+// startMerge drains every leg's snapshot phase sequentially, in the order
+// they appear in s.legs, onto s.eventCh, followed by exactly one combined
+// end-of-snapshot event once all legs have reached theirs; it then starts
+// one goroutine per leg to deliver its live events onto s.eventCh
+// concurrently.
+func (s *Subscription) startMerge(ctx context.Context) {
+	s.eventCh = make(chan subEventOrErr, 32)
+	closeCh := mergedClose(s.forceClose, s.stopCh)
+
+	go func() {
+		for _, leg := range s.legs {
+			for {
+				event, err := leg.next(ctx, closeCh)
+				if err != nil {
+					s.sendMerged(subEventOrErr{err: err})
+					return
+				}
+				if isControlEvent(event) {
+					break
+				}
+				if !s.sendMerged(subEventOrErr{event: s.tagLeg(leg, event)}) {
+					return
+				}
+			}
+		}
+
+		if !s.sendMerged(subEventOrErr{event: Event{Payload: endOfSnapshot{}}}) {
+			return
+		}
+
+		var wg sync.WaitGroup
+		for _, leg := range s.legs {
+			leg := leg
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					event, err := leg.next(ctx, closeCh)
+					if err != nil {
+						s.sendMerged(subEventOrErr{err: err})
+						return
+					}
+					if !s.sendMerged(subEventOrErr{event: s.tagLeg(leg, event)}) {
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	}()
+}
+
+// sendMerged delivers item to s.eventCh, reporting false instead of
+// blocking forever if the Subscription was unsubscribed first.
+func (s *Subscription) sendMerged(item subEventOrErr) bool {
+	select {
+	case s.eventCh <- item:
+		return true
+	case <-s.stopCh:
+		return false
+	}
+}
+
+// tagLeg stamps leg's Topic onto event if the leg (or its SnapshotFunc)
+// didn't already set one, so a multiplexed caller can always tell which
+// TopicKey an event came from.
+func (s *Subscription) tagLeg(leg *subscriptionLeg, event Event) Event {
+	if event.Topic == nil {
+		event.Topic = leg.topic
+	}
+	return event
+}
+
+// mergedClose returns a channel that closes as soon as either a or b does,
+// so a leg blocked in Next can be woken by either a forced close or a plain
+// Unsubscribe.
+func mergedClose(a, b <-chan struct{}) <-chan struct{} {
+	out := make(chan struct{})
+	go func() {
+		select {
+		case <-a:
+		case <-b:
+		}
+		close(out)
+	}()
+	return out
+}
+
+// isControlEvent reports whether e is one of the sentinel events marking a
+// snapshot's boundary, which every leg (regardless of Key) must deliver.
+func isControlEvent(e Event) bool {
+	return e.IsEndOfSnapshot() || e.IsEndOfEmptySnapshot() || e.IsNewSnapshotToFollow()
+}
+
+// Unsubscribe releases the resources held by the Subscription. It must be
+// called exactly once when the caller is done with the Subscription.
+func (s *Subscription) Unsubscribe() {
+	s.stopOnce.Do(func() { close(s.stopCh) })
+	s.unsub()
+}
+
+// forceCloseWith evicts the subscription with err, causing the in-flight or
+// next call to Next to return it rather than waiting on the buffer. Safe to
+// call more than once, from any goroutine; it reports whether this call was
+// the one that actually closed the subscription, so a caller that only
+// wants to act once (e.g. incrementing an evictions counter) can tell a
+// fresh close apart from one that was already in effect.
+func (s *Subscription) forceCloseWith(err error) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closeErr != nil {
+		return false
+	}
+	s.closeErr = err
+	close(s.forceClose)
+	return true
+}
+
+// maxLagEvents resolves the subscriber's configured event-count threshold,
+// falling back to defaultMaxLagEvents when it didn't set MaxLagEvents
+// explicitly (including when it configured a byte-only budget via
+// MaxLagBytes), so a subscriber isn't evicted on event count alone the
+// moment a single event lands.
+func (s *Subscription) maxLagEvents() uint64 {
+	if s.req.MaxLagEvents > 0 {
+		return s.req.MaxLagEvents
+	}
+	return defaultMaxLagEvents
+}
+
+// subscriptionLeg is the portion of a Subscription's state scoped to a
+// single TopicKey: its own position in that topic's buffer, and the Key
+// (possibly WildcardSubscription, or "" which means the same thing) events
+// must match to be delivered.
+type subscriptionLeg struct {
+	sub   *Subscription
+	topic Topic
+	key   string
+	buf   *eventBuffer
+
+	mu          sync.Mutex
+	currentItem *bufferItem
+	currentIdx  int
+}
+
+func newSubscriptionLeg(topic Topic, key string, item *bufferItem, buf *eventBuffer) *subscriptionLeg {
+	return &subscriptionLeg{topic: topic, key: key, buf: buf, currentItem: item}
+}
+
+// matchesKey reports whether an event published under key should be
+// delivered on this leg.
+func (l *subscriptionLeg) matchesKey(key string) bool {
+	return l.key == "" || l.key == WildcardSubscription || l.key == key
+}
+
+// next returns the next event on this leg's buffer that matches its Key and
+// the owning Subscription's Filter, blocking until one is available or ctx
+// (or closeCh) is done. Control events are always returned regardless of Key
+// or Filter, since they mark boundaries every subscriber to the topic needs
+// to observe.
+//
+// Key and Filter are both applied here, at the point each leg walks the
+// topic's (shared) buffer, rather than downstream at the RPC layer: every
+// topic still has exactly one buffer serving every subscriber regardless of
+// their Filter, but an event a Filter rejects is never returned to Next, so
+// it's never encoded onto the wire for that subscriber.
+//
+// closeCh firing is ambiguous on its own (bufferItem.Next always reports it
+// as ErrSubscriptionClosed), so it's resolved here against the owning
+// Subscription's closeErr, which carries the real reason (e.g.
+// ErrSubscriptionLagged) when this leg's own eviction caused it to fire.
+func (l *subscriptionLeg) next(ctx context.Context, closeCh <-chan struct{}) (Event, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for {
+		for l.currentIdx < len(l.currentItem.Events) {
+			event := l.currentItem.Events[l.currentIdx]
+			l.currentIdx++
+			if isControlEvent(event) {
+				return event, nil
+			}
+			if l.matchesKey(event.Key) && l.sub.MatchesFilter(event) {
+				return event, nil
+			}
+		}
+
+		next, err := l.currentItem.Next(ctx, closeCh)
+		if errors.Is(err, ErrSubscriptionClosed) {
+			l.sub.mu.Lock()
+			closeErr := l.sub.closeErr
+			l.sub.mu.Unlock()
+			if closeErr == nil {
+				closeErr = ErrSubscriptionClosed
+			}
+			return Event{}, closeErr
+		}
+		if err != nil {
+			return Event{}, err
+		}
+		if next.Err != nil {
+			return Event{}, next.Err
+		}
+
+		l.currentItem = next
+		l.currentIdx = 0
+	}
+}
+
+// enforcePolicy is called by the publisher after appending new events to
+// buf, to apply the subscriber's SubscriberPolicy if this leg has fallen
+// behind. It reports whether the leg is currently lagged (for the
+// lagged_subscribers gauge).
+func (l *subscriptionLeg) enforcePolicy(metrics Metrics) (lagged bool) {
+	if l.sub.req.Policy == SubscriberPolicyBlock {
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lagEvents, lagBytes := l.buf.LagFrom(l.currentItem)
+	maxEvents := l.sub.maxLagEvents()
+	overLag := lagEvents > maxEvents || (l.sub.req.MaxLagBytes > 0 && lagBytes > l.sub.req.MaxLagBytes)
+	if !overLag {
+		return false
+	}
+
+	switch l.sub.req.Policy {
+	case SubscriberPolicyCloseOnLag:
+		if l.sub.forceCloseWith(ErrSubscriptionLagged) {
+			// Only the call that actually closed the subscription counts as
+			// an eviction; the leg stays registered (and still over lag)
+			// until Unsubscribe, so every Publish after this one would
+			// otherwise re-trigger this branch and inflate the metric.
+			metrics.IncrEvictions(l.topic)
+		}
+		return true
+	case SubscriberPolicyDropOldest:
+		dropped := l.coalesceLocked()
+		metrics.IncrDroppedEvents(l.topic, dropped)
+		return true
+	default:
+		return false
+	}
+}
+
+// coalesceLocked fast-forwards the leg to the live tail, keeping only the
+// most recent event seen for each Key along the way (control events, which
+// have no Key-scoped meaning, are always kept). l.mu must be held.
+func (l *subscriptionLeg) coalesceLocked() (dropped int) {
+	tail := l.buf.Tail()
+
+	latest := make(map[string]Event)
+	var order []string
+	var passthrough []Event
+
+	cur := l.currentItem
+	idx := l.currentIdx
+	for cur != tail || idx < len(cur.Events) {
+		if idx >= len(cur.Events) {
+			cur = cur.next
+			idx = 0
+			continue
+		}
+		event := cur.Events[idx]
+		idx++
+
+		if cur == tail {
+			// tail is linked after the coalesced chain below, so its own
+			// events are delivered from there; here they only supersede
+			// older events for the same Key.
+			if _, ok := latest[event.Key]; ok && event.Key != "" && !isControlEvent(event) {
+				delete(latest, event.Key)
+				dropped++
+			}
+			continue
+		}
+
+		switch {
+		case isControlEvent(event):
+			passthrough = append(passthrough, event)
+		case event.Key == "":
+			passthrough = append(passthrough, event)
+		default:
+			if _, ok := latest[event.Key]; !ok {
+				order = append(order, event.Key)
+			} else {
+				dropped++
+			}
+			latest[event.Key] = event
+		}
+	}
+
+	coalesced := passthrough
+	for _, key := range order {
+		if event, ok := latest[key]; ok {
+			coalesced = append(coalesced, event)
+		}
+	}
+
+	// Every synthetic node built here precedes tail in the stream, so it
+	// carries tail's Seq/ByteSeq forward just like newSnapshotBufferItem
+	// does for snapshot nodes: the subscriber hasn't missed any *live*
+	// event yet, and enforcePolicy's next LagFrom call must see it as
+	// caught up rather than computing a bogus lag against zero.
+	head := newSnapshotBufferItem(tail)
+	node := head
+	for _, event := range coalesced {
+		item := newSnapshotBufferItem(tail)
+		item.Events = []Event{event}
+		node.link(item)
+		node = item
+	}
+	node.link(tail)
+
+	l.currentItem = head
+	l.currentIdx = 0
+	return dropped
+}
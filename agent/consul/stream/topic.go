@@ -0,0 +1,25 @@
+package stream
+
+// Topic is an identifier used to group related events (for example, updates
+// to a particular table in the state store). A Subscription is scoped to one
+// Topic (or, via SubscribeRequest.Topics, several), each optionally narrowed
+// further by Key.
+//
+// Implementations are typically small integer types (see the Topic values
+// defined alongside each state store table) so that they are cheap to use as
+// map keys and to compare.
+type Topic interface {
+	String() string
+}
+
+// WildcardSubscription, used as a TopicKey's Key, means "every Key in this
+// Topic" rather than one in particular.
+const WildcardSubscription = "*"
+
+// TopicKey pairs a Topic with the Key to subscribe to within it, letting a
+// single SubscribeRequest span more than one Topic. See
+// SubscribeRequest.Topics.
+type TopicKey struct {
+	Topic Topic
+	Key   string
+}
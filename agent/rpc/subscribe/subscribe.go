@@ -69,6 +69,9 @@ func (h *Server) Subscribe(req *pbsubscribe.SubscribeRequest, serverStream pbsub
 	for {
 		event, err := sub.Next(ctx)
 		switch {
+		case errors.Is(err, stream.ErrSubscriptionLagged):
+			logger.Trace("subscription closed by server because the client was too slow")
+			return status.Error(codes.ResourceExhausted, err.Error())
 		case errors.Is(err, stream.ErrSubscriptionClosed):
 			logger.Trace("subscription reset by server")
 			return status.Error(codes.Aborted, err.Error())
@@ -77,7 +80,7 @@ func (h *Server) Subscribe(req *pbsubscribe.SubscribeRequest, serverStream pbsub
 		}
 
 		var ok bool
-		event, ok = filterByAuth(authz, event)
+		event, ok = filterEvent(authz, event)
 		if !ok {
 			continue
 		}
@@ -93,13 +96,26 @@ func (h *Server) Subscribe(req *pbsubscribe.SubscribeRequest, serverStream pbsub
 // TODO: can be replaced by mog conversion
 func toStreamSubscribeRequest(req *pbsubscribe.SubscribeRequest) *stream.SubscribeRequest {
 	return &stream.SubscribeRequest{
-		Topic: req.Topic,
-		Key:   req.Key,
-		Token: req.Token,
-		Index: req.Index,
+		Topic:  req.Topic,
+		Key:    req.Key,
+		Topics: toStreamTopicKeys(req.Topics),
+		Token:  req.Token,
+		Index:  req.Index,
+		Filter: req.Filter,
 	}
 }
 
+func toStreamTopicKeys(topics []*pbsubscribe.SubscribeRequest_TopicKey) []stream.TopicKey {
+	if len(topics) == 0 {
+		return nil
+	}
+	keys := make([]stream.TopicKey, len(topics))
+	for i, t := range topics {
+		keys[i] = stream.TopicKey{Topic: t.Topic, Key: t.Key}
+	}
+	return keys
+}
+
 func forwardToDC(
 	req *pbsubscribe.SubscribeRequest,
 	serverStream pbsubscribe.StateChangeSubscription_SubscribeServer,
@@ -127,22 +143,34 @@ func forwardToDC(
 	}
 }
 
-// filterByAuth to only those Events allowed by the acl token.
-func filterByAuth(authz acl.Authorizer, event stream.Event) (stream.Event, bool) {
-	// authz will be nil when ACLs are disabled
-	if authz == nil {
-		return event, true
-	}
-	fn := func(e stream.Event) bool {
-		return enforceACL(authz, e) == acl.Allow
-	}
-	return event.Filter(fn)
+// filterEvent narrows event down to only what the acl token is allowed to
+// see. The subscription's Filter expression (if any) was already applied as
+// the event was read off the subscription's buffer, in
+// subscriptionLeg.next, so there's no need to re-evaluate it here.
+func filterEvent(authz acl.Authorizer, event stream.Event) (stream.Event, bool) {
+	return event.Filter(func(e stream.Event) bool {
+		// authz will be nil when ACLs are disabled
+		return authz == nil || enforceACL(authz, e) == acl.Allow
+	})
 }
 
 func newEventFromStreamEvent(req *pbsubscribe.SubscribeRequest, event stream.Event) *pbsubscribe.Event {
+	// A single-topic request's events don't necessarily carry their own
+	// Topic/Key (the snapshot handler has no reason to restate what's
+	// already implied by req), so fall back to req's. A multi-topic
+	// request's merged stream tags every event with its Topic itself (see
+	// Subscription.Next), which takes precedence so the caller can tell
+	// which of the requested Topics it came from.
+	topic, key := req.Topic, req.Key
+	if t, ok := event.Topic.(pbsubscribe.Topic); ok {
+		topic = t
+	}
+	if event.Key != "" {
+		key = event.Key
+	}
 	e := &pbsubscribe.Event{
-		Topic: req.Topic,
-		Key:   req.Key,
+		Topic: topic,
+		Key:   key,
 		Index: event.Index,
 	}
 	switch {
@@ -152,6 +180,9 @@ func newEventFromStreamEvent(req *pbsubscribe.SubscribeRequest, event stream.Eve
 	case event.IsEndOfEmptySnapshot():
 		e.Payload = &pbsubscribe.Event_EndOfEmptySnapshot{EndOfEmptySnapshot: true}
 		return e
+	case event.IsNewSnapshotToFollow():
+		e.Payload = &pbsubscribe.Event_NewSnapshotToFollow{NewSnapshotToFollow: true}
+		return e
 	}
 	setPayload(e, event.Payload)
 	return e